@@ -0,0 +1,114 @@
+package port
+
+import (
+	"sync"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/allocator/network/errors"
+)
+
+// HostAllocator tracks which host-mode PublishedPorts are reserved on each
+// node in the cluster. The main Allocator deliberately ignores host-mode
+// ports everywhere (they're bound directly by the runtime on the node, not
+// drawn from the ingress/dynamic port space), which means swarmkit
+// otherwise has no way to notice that two services both want to publish
+// the same host port on the same node until the container runtime fails to
+// bind it. HostAllocator exists so the scheduler can check for that
+// conflict up front, at scheduling time, instead.
+//
+// HostAllocator is safe for concurrent use.
+type HostAllocator struct {
+	mu sync.Mutex
+
+	// nodePorts maps a node ID to the set of host-mode ports reserved on
+	// it.
+	nodePorts map[string]map[port]struct{}
+}
+
+// NewHostAllocator returns a new, empty HostAllocator.
+func NewHostAllocator() *HostAllocator {
+	return &HostAllocator{
+		nodePorts: make(map[string]map[port]struct{}),
+	}
+}
+
+// hostPortsOf extracts the host-mode (protocol, port) pairs out of ports,
+// ignoring anything that isn't a host-mode publish or doesn't have a
+// published port assigned yet.
+func hostPortsOf(ports []*api.PortConfig) []port {
+	out := make([]port, 0, len(ports))
+	for _, p := range ports {
+		if p.PublishMode != api.PublishModeHost || p.PublishedPort == 0 {
+			continue
+		}
+		out = append(out, port{protocol: p.Protocol, port: p.PublishedPort})
+	}
+	return out
+}
+
+// ReserveOnNode reserves the host-mode ports in ports for use on the node
+// nodeID. If any of them are already reserved on that node, ReserveOnNode
+// reserves none of them and returns ErrResourceInUse.
+func (h *HostAllocator) ReserveOnNode(nodeID string, ports []*api.PortConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	toReserve := hostPortsOf(ports)
+	existing := h.nodePorts[nodeID]
+	for _, p := range toReserve {
+		if _, ok := existing[p]; ok {
+			return errors.ErrResourceInUse("host port", p.String())
+		}
+	}
+
+	if existing == nil {
+		existing = make(map[port]struct{}, len(toReserve))
+		h.nodePorts[nodeID] = existing
+	}
+	for _, p := range toReserve {
+		existing[p] = struct{}{}
+	}
+	return nil
+}
+
+// ReleaseOnNode releases the host-mode ports in ports that were previously
+// reserved on the node nodeID. Releasing a port that isn't reserved is a
+// no-op.
+func (h *HostAllocator) ReleaseOnNode(nodeID string, ports []*api.PortConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	existing, ok := h.nodePorts[nodeID]
+	if !ok {
+		return
+	}
+	for _, p := range hostPortsOf(ports) {
+		delete(existing, p)
+	}
+	if len(existing) == 0 {
+		delete(h.nodePorts, nodeID)
+	}
+}
+
+// Restore discards whatever this HostAllocator currently has tracked and
+// rebuilds it from nodePorts, a map of node ID to the host-mode ports
+// reserved on that node. Callers should assemble nodePorts from the
+// current set of tasks (and their assigned nodes) on leader election,
+// since an Endpoint alone doesn't carry node placement.
+func (h *HostAllocator) Restore(nodePorts map[string][]*api.PortConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nodePorts = make(map[string]map[port]struct{}, len(nodePorts))
+	for nodeID, ports := range nodePorts {
+		reserved := hostPortsOf(ports)
+		if len(reserved) == 0 {
+			continue
+		}
+		set := make(map[port]struct{}, len(reserved))
+		for _, p := range reserved {
+			set[p] = struct{}{}
+		}
+		h.nodePorts[nodeID] = set
+	}
+}
@@ -0,0 +1,81 @@
+package port
+
+import (
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+)
+
+func hostPort(protocol api.PortConfig_Protocol, publishedPort uint32) *api.PortConfig {
+	return &api.PortConfig{
+		Protocol:      protocol,
+		PublishedPort: publishedPort,
+		PublishMode:   api.PublishModeHost,
+	}
+}
+
+func TestHostAllocatorReserveConflict(t *testing.T) {
+	h := NewHostAllocator()
+
+	if err := h.ReserveOnNode("node1", []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)}); err != nil {
+		t.Fatalf("first ReserveOnNode: %v", err)
+	}
+	if err := h.ReserveOnNode("node1", []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)}); err == nil {
+		t.Fatal("expected a conflict reserving the same host port on the same node twice, got nil")
+	}
+	// the same port on a different node should not conflict.
+	if err := h.ReserveOnNode("node2", []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)}); err != nil {
+		t.Fatalf("expected no conflict reserving port 8080 on a different node, got: %v", err)
+	}
+}
+
+func TestHostAllocatorReleaseOnNode(t *testing.T) {
+	h := NewHostAllocator()
+	ports := []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)}
+
+	if err := h.ReserveOnNode("node1", ports); err != nil {
+		t.Fatalf("ReserveOnNode: %v", err)
+	}
+	h.ReleaseOnNode("node1", ports)
+	if err := h.ReserveOnNode("node1", ports); err != nil {
+		t.Fatalf("expected port 8080 to be reservable again after release, got: %v", err)
+	}
+}
+
+func TestHostAllocatorRestore(t *testing.T) {
+	h := NewHostAllocator()
+	if err := h.ReserveOnNode("stale", []*api.PortConfig{hostPort(api.PortConfig_TCP, 1111)}); err != nil {
+		t.Fatalf("ReserveOnNode: %v", err)
+	}
+
+	h.Restore(map[string][]*api.PortConfig{
+		"node1": {hostPort(api.PortConfig_TCP, 8080)},
+	})
+
+	// Restore discards whatever was tracked before.
+	if err := h.ReserveOnNode("stale", []*api.PortConfig{hostPort(api.PortConfig_TCP, 1111)}); err != nil {
+		t.Fatalf("expected stale reservation to be gone after Restore, got conflict: %v", err)
+	}
+	// but it reflects what was passed in.
+	if err := h.ReserveOnNode("node1", []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)}); err == nil {
+		t.Fatal("expected restored reservation on node1:8080/tcp to conflict, got nil")
+	}
+}
+
+func TestAllocatorRestoreRebuildsHostView(t *testing.T) {
+	a := NewAllocator()
+	tasks := []*api.Task{
+		{
+			NodeID: "node1",
+			Endpoint: &api.Endpoint{
+				Ports: []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)},
+			},
+		},
+	}
+
+	a.Restore(nil, tasks)
+
+	if err := a.HostView().ReserveOnNode("node1", []*api.PortConfig{hostPort(api.PortConfig_TCP, 8080)}); err == nil {
+		t.Fatal("expected Restore to have reserved node1:8080/tcp from the task's Endpoint, got nil conflict")
+	}
+}
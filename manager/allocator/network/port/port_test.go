@@ -0,0 +1,254 @@
+package port
+
+import (
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+)
+
+func newTCPSpec(publishedPort uint32) *api.EndpointSpec {
+	return &api.EndpointSpec{
+		Ports: []*api.PortConfig{
+			{
+				Name:          "http",
+				Protocol:      api.PortConfig_TCP,
+				TargetPort:    80,
+				PublishedPort: publishedPort,
+			},
+		},
+	}
+}
+
+func TestAllocateDynamicRange(t *testing.T) {
+	a, err := NewAllocatorWithConfig(Config{DynamicStart: 40000, DynamicEnd: 40002})
+	if err != nil {
+		t.Fatalf("NewAllocatorWithConfig: %v", err)
+	}
+
+	endpoint := &api.Endpoint{}
+	prop, err := a.Allocate(endpoint, &api.EndpointSpec{
+		Ports: []*api.PortConfig{{Protocol: api.PortConfig_TCP, TargetPort: 80}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	got := prop.Ports()[0].PublishedPort
+	if got < 40000 || got > 40002 {
+		t.Fatalf("PublishedPort %v is outside the configured range [40000,40002]", got)
+	}
+}
+
+func TestNewAllocatorWithConfigRejectsInvertedRange(t *testing.T) {
+	if _, err := NewAllocatorWithConfig(Config{DynamicStart: 40000, DynamicEnd: 39999}); err == nil {
+		t.Fatal("expected an error for DynamicStart > DynamicEnd, got nil")
+	}
+}
+
+func TestNewAllocatorWithConfigRejectsZeroStart(t *testing.T) {
+	// DynamicStart left at its zero value (e.g. only DynamicEnd set in the
+	// struct literal) must not silently produce a dynamic range starting
+	// at port 0, which collides with the "assign me dynamically" sentinel
+	// used throughout this package.
+	if _, err := NewAllocatorWithConfig(Config{DynamicEnd: 2}); err == nil {
+		t.Fatal("expected an error for DynamicStart == 0, got nil")
+	}
+}
+
+func TestNewAllocatorWithConfigRejectsOutOfRangeEnd(t *testing.T) {
+	if _, err := NewAllocatorWithConfig(Config{DynamicStart: 70000, DynamicEnd: 70005}); err == nil {
+		t.Fatal("expected an error for DynamicEnd outside the valid 16-bit port range, got nil")
+	}
+}
+
+func TestAllocateHonorsReservedPorts(t *testing.T) {
+	a, err := NewAllocatorWithConfig(Config{
+		DynamicStart: 40000,
+		DynamicEnd:   40001,
+		ReservedPorts: map[api.PortConfig_Protocol]map[uint32]struct{}{
+			api.PortConfig_TCP: {40000: struct{}{}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAllocatorWithConfig: %v", err)
+	}
+
+	endpoint := &api.Endpoint{}
+	prop, err := a.Allocate(endpoint, &api.EndpointSpec{
+		Ports: []*api.PortConfig{{Protocol: api.PortConfig_TCP, TargetPort: 80}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if got := prop.Ports()[0].PublishedPort; got != 40001 {
+		t.Fatalf("expected reserved port 40000 to be skipped in favor of 40001, got %v", got)
+	}
+}
+
+func TestAllocateRotatingCursorAdvances(t *testing.T) {
+	a, err := NewAllocatorWithConfig(Config{DynamicStart: 40000, DynamicEnd: 40005})
+	if err != nil {
+		t.Fatalf("NewAllocatorWithConfig: %v", err)
+	}
+
+	var last uint32
+	for i := 0; i < 3; i++ {
+		endpoint := &api.Endpoint{}
+		prop, err := a.Allocate(endpoint, &api.EndpointSpec{
+			Ports: []*api.PortConfig{{Protocol: api.PortConfig_TCP, TargetPort: 80}},
+		})
+		if err != nil {
+			t.Fatalf("Allocate %d: %v", i, err)
+		}
+		got := prop.Ports()[0].PublishedPort
+		if i > 0 && got <= last {
+			t.Fatalf("expected dynamic port to advance past %v, got %v", last, got)
+		}
+		prop.Commit()
+		last = got
+	}
+}
+
+func TestAllocateMixedProtocolSamePublishedPort(t *testing.T) {
+	a := NewAllocator()
+
+	endpoint := &api.Endpoint{}
+	prop, err := a.Allocate(endpoint, &api.EndpointSpec{
+		Ports: []*api.PortConfig{
+			{Protocol: api.PortConfig_TCP, TargetPort: 80, PublishedPort: 8080},
+			{Protocol: api.PortConfig_UDP, TargetPort: 80, PublishedPort: 8080},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected TCP and UDP to both be allowed on PublishedPort 8080, got error: %v", err)
+	}
+	prop.Commit()
+
+	// a second endpoint requesting the same TCP port should now conflict,
+	// but the same port on SCTP should not, because protocols are tracked
+	// independently.
+	other := &api.Endpoint{}
+	if _, err := a.Allocate(other, &api.EndpointSpec{
+		Ports: []*api.PortConfig{{Protocol: api.PortConfig_TCP, TargetPort: 80, PublishedPort: 8080}},
+	}); err == nil {
+		t.Fatal("expected a TCP conflict on PublishedPort 8080, got nil error")
+	}
+	if _, err := a.Allocate(other, &api.EndpointSpec{
+		Ports: []*api.PortConfig{{Protocol: api.PortConfig_SCTP, TargetPort: 80, PublishedPort: 8080}},
+	}); err != nil {
+		t.Fatalf("expected SCTP on PublishedPort 8080 to succeed independently of TCP/UDP, got: %v", err)
+	}
+}
+
+func TestAllocateRejectsUnknownProtocol(t *testing.T) {
+	a := NewAllocator()
+	endpoint := &api.Endpoint{}
+	_, err := a.Allocate(endpoint, &api.EndpointSpec{
+		Ports: []*api.PortConfig{{Protocol: api.PortConfig_Protocol(99), TargetPort: 80, PublishedPort: 8080}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown protocol, got nil")
+	}
+}
+
+func TestProposalDiff(t *testing.T) {
+	a := NewAllocator()
+	endpoint := &api.Endpoint{}
+	spec := newTCPSpec(8080)
+
+	prop, err := a.Allocate(endpoint, spec)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	diff := prop.Diff()
+	if len(diff.Added) != 1 || diff.Added[0].PublishedPort != 8080 {
+		t.Fatalf("expected port 8080 to show up as Added, got %+v", diff.Added)
+	}
+	if len(diff.Removed) != 0 || len(diff.Reused) != 0 {
+		t.Fatalf("expected no Removed/Reused entries on first allocation, got %+v", diff)
+	}
+	prop.Commit()
+
+	// Diff must still report the same thing after Commit.
+	after := prop.Diff()
+	if len(after.Added) != 1 || after.Added[0].PublishedPort != 8080 {
+		t.Fatalf("expected Diff() after Commit() to still report port 8080 as Added, got %+v", after.Added)
+	}
+}
+
+func TestProposalDiffUnchangedExplicitPortIsNotReused(t *testing.T) {
+	a := NewAllocator()
+	endpoint := &api.Endpoint{}
+	spec := newTCPSpec(8080)
+
+	prop, err := a.Allocate(endpoint, spec)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	endpoint.Ports = prop.Ports()
+	endpoint.Spec = spec
+	prop.Commit()
+
+	// re-allocate the same endpoint with the same explicit port: nothing
+	// changed, so this must not show up as Reused, which is reserved for
+	// genuine dynamic-port reassignments.
+	prop, err = a.Allocate(endpoint, spec)
+	if err != nil {
+		t.Fatalf("second Allocate: %v", err)
+	}
+	diff := prop.Diff()
+	if len(diff.Reused) != 0 {
+		t.Fatalf("expected an unchanged explicit port not to be reported as Reused, got %+v", diff.Reused)
+	}
+	if len(diff.Added) != 0 {
+		t.Fatalf("expected an unchanged explicit port not to be reported as Added either, got %+v", diff.Added)
+	}
+}
+
+func TestProposalDiffDynamicPortReuseIsReused(t *testing.T) {
+	a := NewAllocator()
+	endpoint := &api.Endpoint{}
+	dynamicSpec := &api.EndpointSpec{
+		Ports: []*api.PortConfig{{Protocol: api.PortConfig_TCP, TargetPort: 80}},
+	}
+
+	prop, err := a.Allocate(endpoint, dynamicSpec)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	endpoint.Ports = prop.Ports()
+	endpoint.Spec = dynamicSpec
+	prop.Commit()
+
+	// re-allocate with the same (still unset) dynamic spec: the allocator
+	// should recover the same PublishedPort, and Diff should call that out
+	// as Reused.
+	prop, err = a.Allocate(endpoint, dynamicSpec)
+	if err != nil {
+		t.Fatalf("second Allocate: %v", err)
+	}
+	diff := prop.Diff()
+	if len(diff.Reused) != 1 {
+		t.Fatalf("expected the recovered dynamic port to be reported as Reused, got %+v", diff)
+	}
+}
+
+func TestProposalCommitIdempotent(t *testing.T) {
+	a := NewAllocator()
+	endpoint := &api.Endpoint{}
+	prop, err := a.Allocate(endpoint, newTCPSpec(8080))
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	endpoint.Ports = prop.Ports()
+	endpoint.Spec = newTCPSpec(8080)
+	prop.Commit()
+	// Calling Commit a second time must not double-apply or panic.
+	prop.Commit()
+
+	// the port should still be allocated exactly once: a second endpoint
+	// asking for it should conflict.
+	other := &api.Endpoint{}
+	if _, err := a.Allocate(other, newTCPSpec(8080)); err == nil {
+		t.Fatal("expected port 8080 to still be in use after a repeated Commit, got nil error")
+	}
+}